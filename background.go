@@ -0,0 +1,162 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"sync"
+	"time"
+)
+
+// startBackgroundProbe runs runProbe once against brokers, reporting into
+// the global label-vector metrics served on /metrics. Metrics that still
+// carry a single "broker" label (for backwards compatibility) use the first
+// configured broker; per-broker detail is exposed separately via
+// brokerConnects and activeBrokerIndex. This is the exporter's original mode
+// of operation, kept for backwards compatibility behind -background.enable;
+// new deployments should prefer the /probe endpoint.
+func startBackgroundProbe(name string, brokers []string, moduleConfig moduleConfig) {
+	broker := brokers[0]
+
+	messagesPublished.WithLabelValues(name, broker).Add(0)
+	messagesPublishTimeout.WithLabelValues(name, broker).Add(0)
+	messagesReceived.WithLabelValues(name, broker).Add(0)
+	messagesDuplicated.WithLabelValues(name, broker).Add(0)
+	messagesOutOfOrder.WithLabelValues(name, broker).Add(0)
+	timedoutTests.WithLabelValues(name, broker).Add(0)
+	errors.WithLabelValues(name, broker).Add(0)
+
+	probeStarted.WithLabelValues(name, broker).Inc()
+	outcome := runProbe(&moduleConfig, brokers, probeHooks{
+		reportError: func(label string, err error) {
+			logger.Printf("Probe %s: %s -> %s", name, label, err.Error())
+		},
+		observeLatency: func(latency time.Duration) {
+			messageLatency.WithLabelValues(name, broker).Observe(latency.Seconds())
+		},
+		reportSubackReasonCode: func(code byte) {
+			subackReasonCode.WithLabelValues(name, broker, fmt.Sprintf("0x%02x", code)).Inc()
+		},
+		reportPubackReasonCode: func(code byte) {
+			pubackReasonCode.WithLabelValues(name, broker, fmt.Sprintf("0x%02x", code)).Inc()
+		},
+		reportBrokerConnectResult: func(connectedBroker string, success bool) {
+			if success {
+				brokerConnects.WithLabelValues(name, connectedBroker).Inc()
+			}
+		},
+		reportActiveBrokerIndex: func(index int) {
+			activeBrokerIndex.WithLabelValues(name).Set(float64(index))
+		},
+	})
+
+	messagesPublished.WithLabelValues(name, broker).Add(float64(outcome.MessagesPublished))
+	messagesPublishTimeout.WithLabelValues(name, broker).Add(float64(outcome.MessagesPublishTimeout))
+	messagesReceived.WithLabelValues(name, broker).Add(float64(outcome.MessagesReceived))
+	messagesDuplicated.WithLabelValues(name, broker).Add(float64(outcome.MessagesDuplicated))
+	messagesOutOfOrder.WithLabelValues(name, broker).Add(float64(outcome.MessagesOutOfOrder))
+	errors.WithLabelValues(name, broker).Add(float64(outcome.Errors))
+	if outcome.TimedOut {
+		timedoutTests.WithLabelValues(name, broker).Inc()
+	}
+
+	probeCompleted.WithLabelValues(name, broker).Inc()
+	probeDuration.WithLabelValues(name, broker).Observe(outcome.Duration.Seconds())
+	if *enableDebug {
+		logger.Printf("Probe %s: took %d ms", name, outcome.Duration.Milliseconds())
+	}
+}
+
+// runningProbe tracks a single background-loop goroutine so it can be
+// stopped again when the probe is removed or changed on reload.
+type runningProbe struct {
+	cancel context.CancelFunc
+	config staticProbeConfig
+	module moduleConfig
+}
+
+// backgroundManager runs the legacy background-loop mode and reconciles its
+// set of goroutines against a new config on SIGHUP: probes that disappeared
+// are stopped, changed probes are restarted, and new probes are started,
+// while unaffected probes keep running undisturbed.
+type backgroundManager struct {
+	mu      sync.Mutex
+	running map[string]*runningProbe
+}
+
+func newBackgroundManager() *backgroundManager {
+	return &backgroundManager{running: map[string]*runningProbe{}}
+}
+
+// reconcile updates the set of running background probes to match cfg.
+func (m *backgroundManager) reconcile(cfg *config) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	wanted := map[string]staticProbeConfig{}
+	for _, staticProbe := range cfg.Probes {
+		wanted[staticProbe.Name] = staticProbe
+	}
+
+	for name, probe := range m.running {
+		_, ok := wanted[name]
+		if !ok {
+			logger.Printf("Probe %s: removed from config, stopping", name)
+			probe.cancel()
+			delete(m.running, name)
+		}
+	}
+
+	stop := func(name string) {
+		if probe, ok := m.running[name]; ok {
+			probe.cancel()
+			delete(m.running, name)
+		}
+	}
+
+	for name, staticProbe := range wanted {
+		if len(staticProbe.Targets) == 0 {
+			logger.Printf("Probe %s: no targets configured, skipping", staticProbe.Name)
+			stop(name)
+			continue
+		}
+
+		module, ok := cfg.Modules[staticProbe.Module]
+		if !ok {
+			logger.Printf("Probe %s: unknown module %q, skipping", staticProbe.Name, staticProbe.Module)
+			stop(name)
+			continue
+		}
+
+		if probe, ok := m.running[name]; ok {
+			if reflect.DeepEqual(probe.config, staticProbe) && reflect.DeepEqual(probe.module, module) {
+				continue
+			}
+			logger.Printf("Probe %s: config changed, restarting", name)
+			probe.cancel()
+		}
+
+		m.running[name] = m.start(staticProbe, module)
+	}
+}
+
+func (m *backgroundManager) start(staticProbe staticProbeConfig, module moduleConfig) *runningProbe {
+	delay := staticProbe.Interval
+	if delay == 0 {
+		delay = 60 * time.Second
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func(ctx context.Context, name string, targets []string, module moduleConfig, delay time.Duration) {
+		for {
+			startBackgroundProbe(name, targets, module)
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(delay):
+			}
+		}
+	}(ctx, staticProbe.Name, staticProbe.Targets, module, delay)
+
+	return &runningProbe{cancel: cancel, config: staticProbe, module: module}
+}
@@ -0,0 +1,23 @@
+package main
+
+import "testing"
+
+// TestReconcileSkipsProbeWithoutTargets ensures a probes entry with no
+// targets is skipped rather than handed to start(), whose goroutine calls
+// startBackgroundProbe, which indexes brokers[0] and would panic on an
+// empty slice.
+func TestReconcileSkipsProbeWithoutTargets(t *testing.T) {
+	m := newBackgroundManager()
+	cfg := &config{
+		Modules: map[string]moduleConfig{"default": {}},
+		Probes: []staticProbeConfig{
+			{Name: "no-targets", Module: "default"},
+		},
+	}
+
+	m.reconcile(cfg)
+
+	if _, ok := m.running["no-targets"]; ok {
+		t.Fatalf("expected probe with no targets to be skipped, but it was started")
+	}
+}
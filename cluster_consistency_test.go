@@ -0,0 +1,24 @@
+package main
+
+import "testing"
+
+// TestRunProbeClusterConsistencyRequiresTwoBrokers covers the fast-fail path:
+// no network is involved, since cluster_consistency with too few brokers is
+// rejected before either client attempts to connect.
+func TestRunProbeClusterConsistencyRequiresTwoBrokers(t *testing.T) {
+	moduleConfig := &moduleConfig{ClusterConsistency: true}
+
+	var errs []string
+	outcome := runProbe(moduleConfig, []string{"tcp://broker.invalid:1883"}, probeHooks{
+		reportError: func(label string, err error) {
+			errs = append(errs, label)
+		},
+	})
+
+	if outcome.Success {
+		t.Fatalf("expected failure with a single broker configured")
+	}
+	if len(errs) != 1 || errs[0] != "cluster consistency probe" {
+		t.Fatalf("expected a single cluster-consistency error, got %v", errs)
+	}
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+// loadConfig reads and parses the exporter's YAML configuration file. It is
+// used both for the initial startup read and for reloading on SIGHUP.
+func loadConfig(path string) (config, error) {
+	yamlFile, err := os.ReadFile(path)
+	if err != nil {
+		return config{}, err
+	}
+
+	cfg := config{}
+	if err := yaml.Unmarshal(yamlFile, &cfg); err != nil {
+		return config{}, err
+	}
+	if err := validateConfig(cfg); err != nil {
+		return config{}, err
+	}
+	return cfg, nil
+}
+
+// validateConfig checks every module's protocol_version, an error that would
+// otherwise only surface the first time a probe actually runs against it:
+// an unsupported protocol_version would otherwise sit silently in
+// the config (accepted at load time, then failing one /probe scrape at a
+// time) until someone notices probe_success is 0.
+func validateConfig(cfg config) error {
+	for name, m := range cfg.Modules {
+		if _, err := protocolVersion(m.ProtocolVersion); err != nil {
+			return fmt.Errorf("module %q: %s", name, err.Error())
+		}
+	}
+	return nil
+}
+
+// configStore holds the exporter's current configuration behind a lock, so
+// the /probe handler always sees the latest config.yaml after a SIGHUP
+// reload even though it keeps running across reloads.
+type configStore struct {
+	mu  sync.RWMutex
+	cfg config
+}
+
+func newConfigStore(cfg config) *configStore {
+	return &configStore{cfg: cfg}
+}
+
+func (s *configStore) get() config {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.cfg
+}
+
+func (s *configStore) set(cfg config) {
+	s.mu.Lock()
+	s.cfg = cfg
+	s.mu.Unlock()
+}
+
+// config is the top-level shape of the exporter's YAML configuration file.
+type config struct {
+	// Modules defines the set of reusable probe configurations, keyed by
+	// module name. A module describes how to talk to a broker (auth, TLS,
+	// topics, ...) but not which broker to talk to; the broker is supplied
+	// per probe, either via the /probe endpoint's target query parameter or
+	// via a static probe entry below.
+	Modules map[string]moduleConfig `yaml:"modules"`
+
+	// Probes configures the legacy background-loop mode: each entry binds a
+	// module to a fixed set of target brokers and runs it on a timer, the
+	// same way the exporter behaved before the /probe endpoint existed. Only
+	// used when -background.enable is set.
+	Probes []staticProbeConfig `yaml:"probes"`
+}
+
+// moduleConfig describes how to run a probe against a broker: auth, TLS,
+// topics and timing. It intentionally excludes the broker address itself so
+// that a single module can be reused against arbitrary targets.
+type moduleConfig struct {
+	SubscribeTopic     string        `yaml:"subscribe_topic"`
+	Topic              string        `yaml:"topic"`
+	ClientPrefix       string        `yaml:"client_prefix"`
+	Username           string        `yaml:"username"`
+	Password           string        `yaml:"password"`
+	ClientCert         string        `yaml:"client_cert"`
+	ClientKey          string        `yaml:"client_key"`
+	CAChain            string        `yaml:"ca_chain"`
+	InsecureSkipVerify bool          `yaml:"insecure_skip_verify"`
+	Messages           int           `yaml:"messages"`
+	Timeout            time.Duration `yaml:"timeout"`
+	MessagePayload     string        `yaml:"message_payload"`
+
+	// QoS is the MQTT quality of service level (0, 1 or 2) used for both the
+	// publish and the subscribe side of the probe.
+	QoS byte `yaml:"qos"`
+	// Retain sets the retain flag on published probe messages.
+	Retain bool `yaml:"retain"`
+	// CleanSession controls whether the broker discards session state on
+	// disconnect. Defaults to true (the MQTT and library default) when unset.
+	CleanSession *bool `yaml:"clean_session"`
+	// KeepAlive is the MQTT keep-alive interval. Defaults to the paho client
+	// default (30s) when unset.
+	KeepAlive time.Duration `yaml:"keep_alive"`
+	// ProtocolVersion selects the MQTT protocol version to negotiate: "3.1"
+	// or "3.1.1" (default). "5.0" is not supported: the underlying
+	// eclipse/paho.mqtt.golang client has no v5 support at all (no user
+	// properties, no real SUBACK/PUBACK reason codes beyond a granted/failed
+	// approximation, no v5 shared-subscription semantics). A module
+	// configured with "5.0" is rejected with a clear error when the config
+	// is loaded, and by connectClient before dialing, rather than silently
+	// falling back to an older protocol.
+	ProtocolVersion string `yaml:"protocol_version"`
+
+	// HTTPHeaders are sent with the websocket handshake when Broker uses the
+	// ws:// or wss:// scheme; ignored for plain tcp/ssl brokers. Useful for
+	// brokers behind reverse proxies that require an auth header.
+	HTTPHeaders map[string]string `yaml:"http_headers"`
+	// ProxyURL, if set, routes the probe's connection through an HTTP proxy.
+	// Only supported for ws:// and wss:// brokers: paho.mqtt.golang's
+	// WebsocketOptions.Proxy is the one dial hook the vendored client exposes
+	// for this, and it only applies to the websocket dialer. Plain tcp/ssl
+	// brokers have no equivalent hook (netconn.go only honors the all_proxy
+	// env var), so probes against those fail fast instead of silently
+	// connecting direct.
+	ProxyURL string `yaml:"proxy_url"`
+
+	// ClusterConsistency switches the probe from its default mode (both
+	// publisher and subscriber fail over across the same broker list) to a
+	// cluster-consistency check: the publisher connects to the first broker
+	// in the list and the subscriber to the second, so the probe measures
+	// whether a message published on one cluster node is actually
+	// replicated to another. Requires at least two brokers.
+	ClusterConsistency bool `yaml:"cluster_consistency"`
+}
+
+func (m *moduleConfig) cleanSession() bool {
+	if m.CleanSession == nil {
+		return true
+	}
+	return *m.CleanSession
+}
+
+// staticProbeConfig binds a module to a fixed set of target brokers for the
+// legacy background-loop mode. Multiple targets enable Paho's server-list
+// failover (or, with moduleConfig.ClusterConsistency, a cross-broker
+// replication check).
+type staticProbeConfig struct {
+	Name     string        `yaml:"name"`
+	Module   string        `yaml:"module"`
+	Targets  []string      `yaml:"targets"`
+	Interval time.Duration `yaml:"interval"`
+}
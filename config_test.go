@@ -0,0 +1,50 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func writeTestConfig(t *testing.T, contents string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(path, []byte(contents), 0o600); err != nil {
+		t.Fatalf("could not write test config: %s", err)
+	}
+	return path
+}
+
+func TestLoadConfigRejectsUnsupportedProtocolVersion(t *testing.T) {
+	path := writeTestConfig(t, `
+modules:
+  default:
+    topic: probe
+    protocol_version: "5.0"
+`)
+
+	_, err := loadConfig(path)
+	if err == nil {
+		t.Fatalf("expected an error, got none")
+	}
+	if !strings.Contains(err.Error(), "protocol_version 5.0 is not supported") {
+		t.Fatalf("expected error to mention the unsupported protocol_version, got %q", err.Error())
+	}
+	if !strings.Contains(err.Error(), `module "default"`) {
+		t.Fatalf("expected error to name the offending module, got %q", err.Error())
+	}
+}
+
+func TestLoadConfigAcceptsSupportedProtocolVersions(t *testing.T) {
+	path := writeTestConfig(t, `
+modules:
+  default:
+    topic: probe
+    protocol_version: "3.1.1"
+`)
+
+	if _, err := loadConfig(path); err != nil {
+		t.Fatalf("expected no error, got %q", err.Error())
+	}
+}
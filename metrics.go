@@ -0,0 +1,221 @@
+package main
+
+import "github.com/prometheus/client_golang/prometheus"
+
+// Metrics for the legacy background-loop mode, registered once against the
+// default registry and served on /metrics, labeled by probe name and broker
+// so a single process can still report on many concurrently running probes.
+var (
+	messagesPublished = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "probe_mqtt_messages_published_total",
+			Help: "Number of published messages.",
+		}, []string{"name", "broker"})
+
+	messagesPublishTimeout = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "probe_mqtt_messages_publish_timeout_total",
+			Help: "Number of published messages that timed out.",
+		}, []string{"name", "broker"})
+
+	messagesReceived = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "probe_mqtt_messages_received_total",
+			Help: "Number of received messages.",
+		}, []string{"name", "broker"})
+
+	timedoutTests = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "probe_mqtt_timeouts_total",
+			Help: "Number of timed out tests.",
+		}, []string{"name", "broker"})
+
+	probeStarted = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "probe_mqtt_started_total",
+			Help: "Number of started probes.",
+		}, []string{"name", "broker"})
+
+	probeCompleted = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "probe_mqtt_completed_total",
+			Help: "Number of completed probes.",
+		}, []string{"name", "broker"})
+
+	errors = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "probe_mqtt_errors_total",
+			Help: "Number of errors occurred during test execution.",
+		}, []string{"name", "broker"})
+
+	probeDuration = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name: "probe_mqtt_duration_seconds",
+			Help: "Time taken to execute probe.",
+		}, []string{"name", "broker"})
+
+	messageLatency = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name: "probe_mqtt_message_latency_seconds",
+			Help: "End-to-end latency between publishing a message and receiving it back.",
+		}, []string{"name", "broker"})
+
+	messagesDuplicated = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "probe_mqtt_messages_duplicated_total",
+			Help: "Number of messages received more than once.",
+		}, []string{"name", "broker"})
+
+	messagesOutOfOrder = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "probe_mqtt_messages_out_of_order_total",
+			Help: "Number of messages received out of the order they were published in.",
+		}, []string{"name", "broker"})
+
+	subackReasonCode = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "probe_mqtt_suback_reason_code",
+			Help: "Number of SUBACKs received, by reason code. Only 0x00 (granted) and 0x80 (failure) are ever reported: eclipse/paho.mqtt.golang doesn't surface the broker's granted QoS or MQTT5's finer-grained reason codes.",
+		}, []string{"name", "broker", "reason_code"})
+
+	pubackReasonCode = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "probe_mqtt_puback_reason_code",
+			Help: "Number of PUBACKs received, by reason code. Only 0x00 (success) and 0x80 (failure) are ever reported: MQTT 3.1.1 PUBACKs carry no reason code, and eclipse/paho.mqtt.golang doesn't support MQTT5's finer-grained ones.",
+		}, []string{"name", "broker", "reason_code"})
+
+	brokerConnects = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "probe_mqtt_broker_connects_total",
+			Help: "Number of successful connects to an individual broker out of a probe's configured broker list.",
+		}, []string{"name", "broker"})
+
+	activeBrokerIndex = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "probe_mqtt_active_broker_index",
+			Help: "Index (0-based, into the probe's configured broker list) of the broker the publisher is currently connected to, or -1 if none.",
+		}, []string{"name"})
+)
+
+func init() {
+	prometheus.MustRegister(probeStarted)
+	prometheus.MustRegister(probeDuration)
+	prometheus.MustRegister(probeCompleted)
+	prometheus.MustRegister(messagesPublished)
+	prometheus.MustRegister(messagesReceived)
+	prometheus.MustRegister(messagesPublishTimeout)
+	prometheus.MustRegister(timedoutTests)
+	prometheus.MustRegister(errors)
+	prometheus.MustRegister(messageLatency)
+	prometheus.MustRegister(messagesDuplicated)
+	prometheus.MustRegister(messagesOutOfOrder)
+	prometheus.MustRegister(subackReasonCode)
+	prometheus.MustRegister(pubackReasonCode)
+	prometheus.MustRegister(brokerConnects)
+	prometheus.MustRegister(activeBrokerIndex)
+}
+
+// requestMetrics holds the single-shot collectors exposed by the /probe
+// endpoint: one fresh registry is created per request, so there is exactly
+// one target in scope and name/broker target labels would be redundant (the
+// Blackbox-Exporter convention). Only the reason-code counters (by
+// reason_code) and the per-broker connect counter (by broker) carry labels.
+type requestMetrics struct {
+	success                prometheus.Gauge
+	duration               prometheus.Gauge
+	messagesPublished      prometheus.Gauge
+	messagesPublishTimeout prometheus.Gauge
+	messagesReceived       prometheus.Gauge
+	messagesDuplicated     prometheus.Gauge
+	messagesOutOfOrder     prometheus.Gauge
+	timedOut               prometheus.Gauge
+	errors                 prometheus.Gauge
+	messageLatency         prometheus.Histogram
+	subackReasonCode       *prometheus.CounterVec
+	pubackReasonCode       *prometheus.CounterVec
+	brokerConnects         *prometheus.CounterVec
+	activeBrokerIndex      prometheus.Gauge
+}
+
+// newRequestMetrics creates a fresh set of probe_* gauges and registers them
+// against registry.
+func newRequestMetrics(registry *prometheus.Registry) *requestMetrics {
+	success := prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "probe_success",
+		Help: "Displays whether or not the probe was a success.",
+	})
+	duration := prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "probe_duration_seconds",
+		Help: "Returns how long the probe took to complete in seconds.",
+	})
+	published := prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "probe_mqtt_messages_published_total",
+		Help: "Number of published messages.",
+	})
+	publishTimeout := prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "probe_mqtt_messages_publish_timeout_total",
+		Help: "Number of published messages that timed out.",
+	})
+	received := prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "probe_mqtt_messages_received_total",
+		Help: "Number of received messages.",
+	})
+	timedOut := prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "probe_mqtt_timeouts_total",
+		Help: "Whether the probe timed out waiting for messages.",
+	})
+	errs := prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "probe_mqtt_errors_total",
+		Help: "Number of errors occurred during test execution.",
+	})
+	duplicated := prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "probe_mqtt_messages_duplicated_total",
+		Help: "Number of messages received more than once.",
+	})
+	outOfOrder := prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "probe_mqtt_messages_out_of_order_total",
+		Help: "Number of messages received out of the order they were published in.",
+	})
+	latency := prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name: "probe_mqtt_message_latency_seconds",
+		Help: "End-to-end latency between publishing a message and receiving it back.",
+	})
+	subackReasonCode := prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "probe_mqtt_suback_reason_code",
+			Help: "Number of SUBACKs received, by reason code. Only 0x00 (granted) and 0x80 (failure) are ever reported: eclipse/paho.mqtt.golang doesn't surface the broker's granted QoS or MQTT5's finer-grained reason codes.",
+		}, []string{"reason_code"})
+	pubackReasonCode := prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "probe_mqtt_puback_reason_code",
+			Help: "Number of PUBACKs received, by reason code. Only 0x00 (success) and 0x80 (failure) are ever reported: MQTT 3.1.1 PUBACKs carry no reason code, and eclipse/paho.mqtt.golang doesn't support MQTT5's finer-grained ones.",
+		}, []string{"reason_code"})
+	brokerConnects := prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "probe_mqtt_broker_connects_total",
+			Help: "Number of successful connects to an individual broker out of the probe's configured broker list.",
+		}, []string{"broker"})
+	activeBrokerIndex := prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "probe_mqtt_active_broker_index",
+		Help: "Index (0-based, into the probe's configured broker list) of the broker the publisher is currently connected to, or -1 if none.",
+	})
+
+	registry.MustRegister(success, duration, published, publishTimeout, received, timedOut, errs, duplicated, outOfOrder, latency, subackReasonCode, pubackReasonCode, brokerConnects, activeBrokerIndex)
+
+	return &requestMetrics{
+		success:                success,
+		duration:               duration,
+		messagesPublished:      published,
+		messagesPublishTimeout: publishTimeout,
+		messagesReceived:       received,
+		messagesDuplicated:     duplicated,
+		messagesOutOfOrder:     outOfOrder,
+		timedOut:               timedOut,
+		subackReasonCode:       subackReasonCode,
+		pubackReasonCode:       pubackReasonCode,
+		errors:                 errs,
+		messageLatency:         latency,
+		brokerConnects:         brokerConnects,
+		activeBrokerIndex:      activeBrokerIndex,
+	}
+}
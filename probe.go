@@ -0,0 +1,524 @@
+package main
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// probeEnvelope is the wire format for a single probed message: it wraps the
+// configured message payload with a sequence number and send timestamp so
+// the subscriber can compute end-to-end latency and detect duplicate or
+// out-of-order deliveries. Both ends of a probe are this binary, so there is
+// no need for a stable public wire format.
+type probeEnvelope struct {
+	Sequence     int    `json:"seq"`
+	SentUnixNano int64  `json:"sent_ns"`
+	Payload      string `json:"payload"`
+}
+
+// sequenceObservation classifies a received message's sequence number
+// relative to every sequence number the tracker has seen so far.
+type sequenceObservation int
+
+const (
+	sequenceInOrder sequenceObservation = iota
+	sequenceDuplicate
+	sequenceOutOfOrder
+)
+
+// sequenceTracker classifies deliveries of a probe's sequenced messages as
+// in-order, duplicate, or out-of-order. It only tracks what it has seen, not
+// what it still expects, since messages may legitimately be dropped (e.g. by
+// QoS 0) without ever arriving.
+type sequenceTracker struct {
+	seen    map[int]bool
+	highest int
+}
+
+func newSequenceTracker() *sequenceTracker {
+	return &sequenceTracker{seen: map[int]bool{}, highest: -1}
+}
+
+// observe records a single received sequence number and classifies it.
+func (t *sequenceTracker) observe(seq int) sequenceObservation {
+	if t.seen[seq] {
+		return sequenceDuplicate
+	}
+	t.seen[seq] = true
+	if seq < t.highest {
+		return sequenceOutOfOrder
+	}
+	t.highest = seq
+	return sequenceInOrder
+}
+
+var letterRunes = []rune("abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ")
+
+func RandStringRunes(n int) string {
+	b := make([]rune, n)
+	for i := range b {
+		b[i] = letterRunes[rand.Intn(len(letterRunes))]
+	}
+	return string(b)
+}
+
+// newTLSConfig sets up the go internal tls config from the given module
+// config, verifying the broker's certificate against serverName. CA chain
+// and client keypair are served from a cached certReloader that watches the
+// underlying files and reloads them on change, so certificate rotation
+// takes effect on the probe's next connection attempt without restarting
+// the exporter.
+func newTLSConfig(moduleConfig *moduleConfig, serverName string) (*tls.Config, error) {
+	if (moduleConfig.ClientCert != "" && moduleConfig.ClientKey == "") ||
+		(moduleConfig.ClientCert == "" && moduleConfig.ClientKey != "") {
+		return nil, fmt.Errorf("either ClientCert or ClientKey is set to empty string")
+	}
+
+	cfg := &tls.Config{
+		ClientAuth: tls.NoClientCert,
+		ServerName: serverName,
+	}
+
+	reloader, err := getOrCreateCertReloader(moduleConfig)
+	if err != nil {
+		return nil, fmt.Errorf("could not set up TLS material reloader: %s", err.Error())
+	}
+
+	// The client keypair is independent of whether the broker's own
+	// certificate gets verified: skipping verification of a self-signed/dev
+	// broker's server cert while still doing mTLS client auth against it is
+	// a legitimate combination.
+	if moduleConfig.ClientCert != "" && reloader != nil {
+		cfg.GetClientCertificate = reloader.getClientCertificate
+	}
+
+	if moduleConfig.InsecureSkipVerify {
+		// You basically trust any server presenting an SSL cert to you,
+		// rendering SSL useless - no need for a CA reloader.
+		cfg.InsecureSkipVerify = true
+		return cfg, nil
+	}
+
+	if reloader == nil {
+		return cfg, nil
+	}
+
+	// Bypass Go's own chain verification (which would pin the RootCAs pool
+	// at dial time, and which Go would skip deriving ServerName for anyway
+	// once InsecureSkipVerify is set) in favor of verifyPeerCertificate,
+	// which always checks against the most recently reloaded pool and does
+	// its own hostname check against serverName.
+	cfg.InsecureSkipVerify = true
+	cfg.VerifyPeerCertificate = reloader.verifyPeerCertificate(serverName)
+
+	return cfg, nil
+}
+
+// protocolVersion maps the module's configured protocol_version string to
+// the numeric value eclipse/paho.mqtt.golang expects via SetProtocolVersion.
+// "5.0" is rejected: that client only implements MQTT 3.1/3.1.1, so v5
+// features (user properties, shared subscription semantics, reason codes)
+// are not available.
+func protocolVersion(version string) (uint, error) {
+	switch version {
+	case "", "3.1.1":
+		return 4, nil
+	case "3.1":
+		return 3, nil
+	case "5.0":
+		return 0, fmt.Errorf("protocol_version 5.0 is not supported: eclipse/paho.mqtt.golang only speaks MQTT 3.1/3.1.1")
+	default:
+		return 0, fmt.Errorf("unknown protocol_version %q", version)
+	}
+}
+
+// isWebsocketBroker reports whether brokers use the ws:// or wss:// scheme.
+// As with the TLS serverName derivation in connectClient, this only looks at the first
+// broker and assumes the rest of the list shares its scheme.
+func isWebsocketBroker(brokers []string) bool {
+	if len(brokers) == 0 {
+		return false
+	}
+	u, err := url.Parse(brokers[0])
+	if err != nil {
+		return false
+	}
+	return u.Scheme == "ws" || u.Scheme == "wss"
+}
+
+// approximatePubackReasonCode approximates a PUBACK reason code for a completed publish
+// token: 0x00 (success) if err is nil, 0x80 (failure) otherwise. It reports
+// ok=false for QoS 0, since there is no PUBACK to approximate at all - paho
+// completes a QoS 0 publish token as soon as the packet is written to the
+// socket, with Error() nil regardless of whether the broker actually
+// accepted it (e.g. a silent ACL deny produces no error to the client).
+func approximatePubackReasonCode(qos byte, err error) (code byte, ok bool) {
+	if qos == 0 {
+		return 0, false
+	}
+	if err != nil {
+		return 0x80, true
+	}
+	return 0x00, true
+}
+
+// queueBufferSize returns the capacity for runProbe's subscriber delivery
+// queue, given the number of messages the probe expects to receive. The
+// buffer holds num+1 deliveries that arrive after the receive loop has
+// stopped reading the channel: room for every message the probe publishes
+// plus one redelivered duplicate. It does not close the underlying deadlock
+// class entirely. A QoS 1/2 redelivery storm producing more post-deadline
+// deliveries than that for the same probe can still fill the buffer and
+// wedge paho's dispatch goroutine exactly as an unbuffered channel would,
+// just with a higher threshold to hit.
+func queueBufferSize(num int) int {
+	return num + 1
+}
+
+// connectClient dials brokers in order (paho.mqtt.golang's own server-list
+// failover: it tries each AddBroker entry in turn and stops at the first one
+// that accepts the connection) and returns the connected client together
+// with the broker that actually accepted it. onAttempt, if set, is called
+// once for every broker paho tries, in order, before the connection result
+// is known.
+func connectClient(moduleConfig *moduleConfig, brokers []string, timeout time.Duration, opts *mqtt.ClientOptions, onAttempt func(broker string)) (mqtt.Client, string, error) {
+	// TLS verification (when not InsecureSkipVerify) checks the presented
+	// chain against this hostname. All brokers in a failover/cluster list
+	// share one tls.Config, so this assumes they also share a certificate
+	// hostname (e.g. a wildcard or SAN-list cert covering the whole
+	// cluster) - true for the failover/cluster-consistency setups this
+	// exporter targets.
+	serverName := ""
+	if len(brokers) > 0 {
+		if u, err := url.Parse(brokers[0]); err == nil {
+			serverName = u.Hostname()
+		}
+	}
+	tlsConfig, err := newTLSConfig(moduleConfig, serverName)
+	if err != nil {
+		return nil, "", fmt.Errorf("could not setup TLS: %s", err.Error())
+	}
+	version, err := protocolVersion(moduleConfig.ProtocolVersion)
+	if err != nil {
+		return nil, "", err
+	}
+	baseOptions := mqtt.NewClientOptions()
+	if opts != nil {
+		baseOptions = opts
+	}
+	baseOptions = baseOptions.SetAutoReconnect(false).
+		SetUsername(moduleConfig.Username).
+		SetPassword(moduleConfig.Password).
+		SetTLSConfig(tlsConfig).
+		SetCleanSession(moduleConfig.cleanSession()).
+		SetProtocolVersion(version)
+	for _, broker := range brokers {
+		baseOptions.AddBroker(broker)
+	}
+	if moduleConfig.KeepAlive > 0 {
+		baseOptions.SetKeepAlive(moduleConfig.KeepAlive)
+	}
+	if len(moduleConfig.HTTPHeaders) > 0 {
+		// Only consulted by paho.mqtt.golang when broker uses the ws:// or
+		// wss:// scheme; harmlessly ignored for plain tcp/ssl brokers.
+		headers := http.Header{}
+		for key, value := range moduleConfig.HTTPHeaders {
+			headers.Set(key, value)
+		}
+		baseOptions.SetHTTPHeaders(headers)
+	}
+	if moduleConfig.ProxyURL != "" {
+		if !isWebsocketBroker(brokers) {
+			return nil, "", fmt.Errorf("proxy_url is only supported for ws:// and wss:// brokers: eclipse/paho.mqtt.golang has no dial hook to route a plain tcp/ssl connection through a proxy")
+		}
+		proxyURL, err := url.Parse(moduleConfig.ProxyURL)
+		if err != nil {
+			return nil, "", fmt.Errorf("could not parse proxy_url: %s", err.Error())
+		}
+		baseOptions.SetWebsocketOptions(&mqtt.WebsocketOptions{Proxy: http.ProxyURL(proxyURL)})
+	}
+	baseOptions.SetConnectionLostHandler(func(c mqtt.Client, err error) {
+		logger.Printf("Probe: lost MQTT connection to %v error: %s", brokers, err.Error())
+	})
+
+	var attempted []string
+	baseOptions.SetConnectionAttemptHandler(func(broker *url.URL, tlsCfg *tls.Config) *tls.Config {
+		attempted = append(attempted, broker.String())
+		if onAttempt != nil {
+			onAttempt(broker.String())
+		}
+		return tlsCfg
+	})
+
+	client := mqtt.NewClient(baseOptions)
+	token := client.Connect()
+	success := token.WaitTimeout(timeout)
+	if !success {
+		return nil, "", fmt.Errorf("reached connect timeout")
+	}
+	if token.Error() != nil {
+		return nil, "", fmt.Errorf("failed to connect client: %s", token.Error().Error())
+	}
+
+	activeBroker := ""
+	if len(attempted) > 0 {
+		activeBroker = attempted[len(attempted)-1]
+	}
+	return client, activeBroker, nil
+}
+
+// probeOutcome carries the result of a single runProbe call, independent of
+// how the caller wants to expose it as metrics (background-loop label
+// vectors or a single-shot /probe registry).
+type probeOutcome struct {
+	Success                bool
+	Duration               time.Duration
+	MessagesPublished      int
+	MessagesPublishTimeout int
+	MessagesReceived       int
+	MessagesDuplicated     int
+	MessagesOutOfOrder     int
+	TimedOut               bool
+	Errors                 int
+}
+
+// probeHooks lets runProbe report events to a caller-chosen metrics
+// representation (background-loop label vectors or a single-shot /probe
+// registry) without knowing about Prometheus itself.
+type probeHooks struct {
+	// reportError is called for every error encountered during the probe.
+	reportError func(label string, err error)
+	// observeLatency is called once per distinct message received with its
+	// end-to-end send-to-receive latency.
+	observeLatency func(time.Duration)
+	// reportSubackReasonCode is called once after the subscribe attempt
+	// completes, with the SUBACK reason code (0x00 granted, 0x80 failure -
+	// eclipse/paho.mqtt.golang doesn't surface the broker's granted QoS or
+	// finer-grained v5 reason codes, so this is the best approximation
+	// available without migrating to eclipse/paho.golang). Not called when
+	// the subscribe times out, since no SUBACK was received.
+	reportSubackReasonCode func(code byte)
+	// reportPubackReasonCode is called once per QoS 1/2 published message
+	// that actually received a PUBACK, with 0x00 (success) or 0x80 (failure) -
+	// the same approximation as reportSubackReasonCode, since v3.1.1 PUBACKs
+	// carry no reason code at all and finer-grained v5 codes aren't
+	// available without migrating to eclipse/paho.golang. Messages that time
+	// out waiting for a PUBACK are counted in MessagesPublishTimeout instead
+	// and don't get a reason code, since no PUBACK was received for them. Not
+	// called for QoS 0 publishes: those have no PUBACK, so paho completes the
+	// token as soon as the packet is written to the socket with Error() nil
+	// regardless of whether the broker accepted it, and reporting 0x00 there
+	// would claim a PUBACK was observed when none was.
+	reportPubackReasonCode func(code byte)
+	// reportBrokerConnectResult is called once for every broker a connect
+	// attempt was made against, with whether that particular broker is the
+	// one the client ended up connected to. paho.mqtt.golang tries brokers in
+	// order and stops at the first success, so every attempted broker before
+	// the successful one (or all of them, if the whole connect failed) is
+	// reported as success=false.
+	reportBrokerConnectResult func(broker string, success bool)
+	// reportActiveBrokerIndex is called once per runProbe call that reaches
+	// the publisher's connect attempt, with the index (into the configured
+	// broker list) of the broker the publisher ended up connected to, or -1
+	// if none did. It is not called when a cluster-consistency probe is
+	// rejected for having fewer than two brokers.
+	reportActiveBrokerIndex func(index int)
+}
+
+// runProbe connects a publisher and subscriber client to brokers using
+// moduleConfig, exchanges moduleConfig.Messages messages end-to-end, and
+// reports what happened via hooks. By default both publisher and subscriber
+// fail over across the same broker list; with moduleConfig.ClusterConsistency
+// set, the publisher instead connects only to brokers[0] and the subscriber
+// only to brokers[1], to check that a cluster actually replicates messages
+// between its nodes.
+func runProbe(moduleConfig *moduleConfig, brokers []string, hooks probeHooks) probeOutcome {
+	outcome := probeOutcome{}
+	t0 := time.Now()
+	defer func() {
+		outcome.Duration = time.Since(t0)
+	}()
+
+	fail := func(label string, err error) {
+		outcome.Errors++
+		hooks.reportError(label, err)
+	}
+
+	publisherBrokers := brokers
+	subscriberBrokers := brokers
+	if moduleConfig.ClusterConsistency {
+		if len(brokers) < 2 {
+			fail("cluster consistency probe", fmt.Errorf("cluster_consistency requires at least 2 brokers, got %d", len(brokers)))
+			return outcome
+		}
+		publisherBrokers = brokers[:1]
+		subscriberBrokers = brokers[1:2]
+	}
+
+	brokerIndex := func(broker string) int {
+		for i, b := range brokers {
+			if b == broker {
+				return i
+			}
+		}
+		return -1
+	}
+
+	num := moduleConfig.Messages
+	minTimeout := 10 * time.Second
+	setupTimeout := moduleConfig.Timeout / 3
+	if setupTimeout < minTimeout {
+		setupTimeout = minTimeout
+	}
+	probeTimeout := moduleConfig.Timeout / 3
+	if probeTimeout < minTimeout {
+		probeTimeout = minTimeout
+	}
+	qos := moduleConfig.QoS
+	setupDeadLine := t0.Add(setupTimeout)
+
+	// Buffered so paho's ordered dispatch goroutine (which calls the
+	// subscriber's publish handler synchronously) never blocks on this send.
+	// Without a buffer, a message that arrives after the receive loop below
+	// has already returned via <-timeout would wedge that goroutine - and
+	// the subscriber client it belongs to - for the rest of the process's
+	// life. See queueBufferSize for the bound this does (and doesn't) give us.
+	queue := make(chan [2]string, queueBufferSize(num))
+
+	clientSuffix := RandStringRunes(5)
+
+	publisherOptions := mqtt.NewClientOptions().
+		SetClientID(fmt.Sprintf("%s-p-%s", moduleConfig.ClientPrefix, clientSuffix))
+
+	subscriberOptions := mqtt.NewClientOptions().
+		SetClientID(fmt.Sprintf("%s-s-%s", moduleConfig.ClientPrefix, clientSuffix)).
+		SetDefaultPublishHandler(func(client mqtt.Client, msg mqtt.Message) {
+			queue <- [2]string{msg.Topic(), string(msg.Payload())}
+		})
+
+	reportAttempts := func(candidates []string, activeBroker string) {
+		if hooks.reportBrokerConnectResult == nil {
+			return
+		}
+		for _, candidate := range candidates {
+			hooks.reportBrokerConnectResult(candidate, candidate == activeBroker)
+		}
+	}
+
+	var publisherAttempts, subscriberAttempts []string
+	publisher, activeBroker, err := connectClient(moduleConfig, publisherBrokers, time.Until(setupDeadLine), publisherOptions, func(b string) {
+		publisherAttempts = append(publisherAttempts, b)
+	})
+	reportAttempts(publisherAttempts, activeBroker)
+	if hooks.reportActiveBrokerIndex != nil {
+		hooks.reportActiveBrokerIndex(brokerIndex(activeBroker))
+	}
+	if err != nil {
+		fail("connect publish client", err)
+		return outcome
+	}
+	defer publisher.Disconnect(5)
+
+	subscriber, subscriberActiveBroker, err := connectClient(moduleConfig, subscriberBrokers, time.Until(setupDeadLine), subscriberOptions, func(b string) {
+		subscriberAttempts = append(subscriberAttempts, b)
+	})
+	reportAttempts(subscriberAttempts, subscriberActiveBroker)
+	if err != nil {
+		fail("connect subscribe client", err)
+		return outcome
+	}
+	defer subscriber.Disconnect(5)
+
+	// subscribeTopic may be a shared subscription ($share/<group>/topic);
+	// paho.mqtt.golang treats it as an opaque topic filter, and brokers that
+	// support shared subscriptions honor the prefix regardless of protocol
+	// version.
+	subscribeTopic := moduleConfig.SubscribeTopic
+	if subscribeTopic == "" {
+		subscribeTopic = moduleConfig.Topic
+	}
+	token := subscriber.Subscribe(subscribeTopic, qos, nil)
+	subscribed := token.WaitTimeout(time.Until(setupDeadLine))
+	if subscribed && token.Error() != nil {
+		if hooks.reportSubackReasonCode != nil {
+			hooks.reportSubackReasonCode(0x80)
+		}
+		fail("subscribe to topic", token.Error())
+		return outcome
+	}
+	if subscribed && hooks.reportSubackReasonCode != nil {
+		hooks.reportSubackReasonCode(0x00)
+	}
+	defer subscriber.Unsubscribe(subscribeTopic)
+
+	probeDeadline := time.Now().Add(probeTimeout)
+	timeout := time.After(probeTimeout)
+	receiveCount := 0
+
+	// Support for custom message payload
+	msgPayload := "This is msg %d!"
+	if moduleConfig.MessagePayload != "" {
+		msgPayload = moduleConfig.MessagePayload
+	}
+
+	for i := 0; i < num; i++ {
+		envelope := probeEnvelope{
+			Sequence:     i,
+			SentUnixNano: time.Now().UnixNano(),
+			Payload:      fmt.Sprintf(msgPayload, i),
+		}
+		text, err := json.Marshal(envelope)
+		if err != nil {
+			fail("marshal message envelope", err)
+			continue
+		}
+		token := publisher.Publish(moduleConfig.Topic, qos, moduleConfig.Retain, text)
+		if !token.WaitTimeout(time.Until(probeDeadline)) {
+			outcome.MessagesPublishTimeout++
+			continue
+		}
+		outcome.MessagesPublished++
+		if code, ok := approximatePubackReasonCode(qos, token.Error()); ok && hooks.reportPubackReasonCode != nil {
+			hooks.reportPubackReasonCode(code)
+		}
+	}
+
+	tracker := newSequenceTracker()
+
+	for receiveCount < num {
+		select {
+		case msg := <-queue:
+			var envelope probeEnvelope
+			if err := json.Unmarshal([]byte(msg[1]), &envelope); err != nil {
+				fail("unmarshal message envelope", err)
+				continue
+			}
+
+			switch tracker.observe(envelope.Sequence) {
+			case sequenceDuplicate:
+				outcome.MessagesDuplicated++
+				continue
+			case sequenceOutOfOrder:
+				outcome.MessagesOutOfOrder++
+			}
+
+			hooks.observeLatency(time.Duration(time.Now().UnixNano() - envelope.SentUnixNano))
+			receiveCount++
+			outcome.MessagesReceived++
+		case <-timeout:
+			outcome.TimedOut = true
+			logger.Printf("Probe: timed out after %d ms (received: %d)", time.Since(t0).Milliseconds(), receiveCount)
+			return outcome
+		}
+	}
+
+	outcome.Success = true
+	return outcome
+}
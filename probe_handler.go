@@ -0,0 +1,76 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// probeHandler serves Blackbox-Exporter-style on-demand probes: given a
+// module name and a target broker URL, it runs a single probe synchronously
+// and renders the result as metrics scoped to this request only. target may
+// be a comma-separated list of broker URLs, in which case the probe fails
+// over across them the same way the legacy background-loop mode's targets do.
+func probeHandler(store *configStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		moduleName := r.URL.Query().Get("module")
+		target := r.URL.Query().Get("target")
+		if target == "" {
+			http.Error(w, "target parameter is missing", http.StatusBadRequest)
+			return
+		}
+		targets := strings.Split(target, ",")
+
+		moduleConfig, ok := store.get().Modules[moduleName]
+		if !ok {
+			http.Error(w, "unknown module "+moduleName, http.StatusBadRequest)
+			return
+		}
+
+		registry := prometheus.NewRegistry()
+		metrics := newRequestMetrics(registry)
+
+		outcome := runProbe(&moduleConfig, targets, probeHooks{
+			reportError: func(label string, err error) {
+				logger.Printf("Probe %s (%s): %s -> %s", moduleName, target, label, err.Error())
+			},
+			observeLatency: func(latency time.Duration) {
+				metrics.messageLatency.Observe(latency.Seconds())
+			},
+			reportSubackReasonCode: func(code byte) {
+				metrics.subackReasonCode.WithLabelValues(fmt.Sprintf("0x%02x", code)).Inc()
+			},
+			reportPubackReasonCode: func(code byte) {
+				metrics.pubackReasonCode.WithLabelValues(fmt.Sprintf("0x%02x", code)).Inc()
+			},
+			reportBrokerConnectResult: func(connectedBroker string, success bool) {
+				if success {
+					metrics.brokerConnects.WithLabelValues(connectedBroker).Inc()
+				}
+			},
+			reportActiveBrokerIndex: func(index int) {
+				metrics.activeBrokerIndex.Set(float64(index))
+			},
+		})
+
+		if outcome.Success {
+			metrics.success.Set(1)
+		}
+		metrics.duration.Set(outcome.Duration.Seconds())
+		metrics.messagesPublished.Set(float64(outcome.MessagesPublished))
+		metrics.messagesPublishTimeout.Set(float64(outcome.MessagesPublishTimeout))
+		metrics.messagesReceived.Set(float64(outcome.MessagesReceived))
+		metrics.messagesDuplicated.Set(float64(outcome.MessagesDuplicated))
+		metrics.messagesOutOfOrder.Set(float64(outcome.MessagesOutOfOrder))
+		metrics.errors.Set(float64(outcome.Errors))
+		if outcome.TimedOut {
+			metrics.timedOut.Set(1)
+		}
+
+		promhttp.HandlerFor(registry, promhttp.HandlerOpts{}).ServeHTTP(w, r)
+	}
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func newTestStore(modules map[string]moduleConfig) *configStore {
+	return newConfigStore(config{Modules: modules})
+}
+
+func TestProbeHandlerMissingTarget(t *testing.T) {
+	store := newTestStore(map[string]moduleConfig{"default": {}})
+	req := httptest.NewRequest(http.MethodGet, "/probe?module=default", nil)
+	rr := httptest.NewRecorder()
+
+	probeHandler(store)(rr, req)
+
+	if rr.Code != http.StatusBadRequest {
+		t.Fatalf("expected %d, got %d", http.StatusBadRequest, rr.Code)
+	}
+}
+
+func TestProbeHandlerUnknownModule(t *testing.T) {
+	store := newTestStore(map[string]moduleConfig{"default": {}})
+	req := httptest.NewRequest(http.MethodGet, "/probe?module=missing&target=tcp://broker.invalid:1883", nil)
+	rr := httptest.NewRecorder()
+
+	probeHandler(store)(rr, req)
+
+	if rr.Code != http.StatusBadRequest {
+		t.Fatalf("expected %d, got %d", http.StatusBadRequest, rr.Code)
+	}
+	if !strings.Contains(rr.Body.String(), "unknown module") {
+		t.Fatalf("expected body to mention the unknown module, got %q", rr.Body.String())
+	}
+}
+
+// TestProbeHandlerConnectFailureReportsFailure exercises the handler's full
+// runProbe/metrics wiring without a live broker: protocol_version 5.0 is
+// rejected by connectClient before it ever dials, so this reaches the
+// request's probe_success metric the same way a real connect failure would.
+func TestProbeHandlerConnectFailureReportsFailure(t *testing.T) {
+	store := newTestStore(map[string]moduleConfig{
+		"default": {ProtocolVersion: "5.0"},
+	})
+	req := httptest.NewRequest(http.MethodGet, "/probe?module=default&target=tcp://broker.invalid:1883", nil)
+	rr := httptest.NewRecorder()
+
+	probeHandler(store)(rr, req)
+
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected %d, got %d", http.StatusOK, rr.Code)
+	}
+	body := rr.Body.String()
+	if !strings.Contains(body, "probe_success 0") {
+		t.Fatalf("expected probe_success 0 in body, got %q", body)
+	}
+	if !strings.Contains(body, "probe_mqtt_errors_total 1") {
+		t.Fatalf("expected probe_mqtt_errors_total 1 in body, got %q", body)
+	}
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSequenceTracker(t *testing.T) {
+	cases := []struct {
+		name string
+		seqs []int
+		want []sequenceObservation
+	}{
+		{
+			name: "in order",
+			seqs: []int{0, 1, 2, 3},
+			want: []sequenceObservation{sequenceInOrder, sequenceInOrder, sequenceInOrder, sequenceInOrder},
+		},
+		{
+			name: "duplicate",
+			seqs: []int{0, 1, 1, 2},
+			want: []sequenceObservation{sequenceInOrder, sequenceInOrder, sequenceDuplicate, sequenceInOrder},
+		},
+		{
+			name: "out of order",
+			seqs: []int{0, 2, 1, 3},
+			want: []sequenceObservation{sequenceInOrder, sequenceInOrder, sequenceOutOfOrder, sequenceInOrder},
+		},
+		{
+			name: "redelivered out of order message is a duplicate, not out of order again",
+			seqs: []int{0, 2, 1, 1},
+			want: []sequenceObservation{sequenceInOrder, sequenceInOrder, sequenceOutOfOrder, sequenceDuplicate},
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			tracker := newSequenceTracker()
+			for i, seq := range tc.seqs {
+				if got := tracker.observe(seq); got != tc.want[i] {
+					t.Fatalf("observe(%d) at step %d: got %v, want %v", seq, i, got, tc.want[i])
+				}
+			}
+		})
+	}
+}
+
+// TestQueueBufferSize documents the bound runProbe's delivery queue buffer
+// actually gives: room for num+1 post-deadline deliveries (every published
+// message plus one duplicate), not protection against a redelivery storm
+// beyond that.
+func TestQueueBufferSize(t *testing.T) {
+	cases := []struct {
+		num  int
+		want int
+	}{
+		{num: 0, want: 1},
+		{num: 1, want: 2},
+		{num: 10, want: 11},
+	}
+
+	for _, tc := range cases {
+		if got := queueBufferSize(tc.num); got != tc.want {
+			t.Fatalf("queueBufferSize(%d) = %d, want %d", tc.num, got, tc.want)
+		}
+	}
+}
+
+// TestApproximatePubackReasonCode covers the QoS 0 case specifically: paho completes a
+// QoS 0 publish token as soon as the packet hits the socket, with Error()
+// nil regardless of whether the broker actually accepted it, so there is no
+// PUBACK to approximate a reason code from at all.
+func TestApproximatePubackReasonCode(t *testing.T) {
+	cases := []struct {
+		name     string
+		qos      byte
+		err      error
+		wantCode byte
+		wantOK   bool
+	}{
+		{name: "QoS 0 has no PUBACK, even on a nil token error", qos: 0, err: nil, wantOK: false},
+		{name: "QoS 0 has no PUBACK, even on a token error", qos: 0, err: fmt.Errorf("boom"), wantOK: false},
+		{name: "QoS 1 success", qos: 1, err: nil, wantCode: 0x00, wantOK: true},
+		{name: "QoS 1 failure", qos: 1, err: fmt.Errorf("boom"), wantCode: 0x80, wantOK: true},
+		{name: "QoS 2 success", qos: 2, err: nil, wantCode: 0x00, wantOK: true},
+		{name: "QoS 2 failure", qos: 2, err: fmt.Errorf("boom"), wantCode: 0x80, wantOK: true},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			code, ok := approximatePubackReasonCode(tc.qos, tc.err)
+			if ok != tc.wantOK {
+				t.Fatalf("approximatePubackReasonCode(%d, %v): ok = %v, want %v", tc.qos, tc.err, ok, tc.wantOK)
+			}
+			if ok && code != tc.wantCode {
+				t.Fatalf("approximatePubackReasonCode(%d, %v): code = %#x, want %#x", tc.qos, tc.err, code, tc.wantCode)
+			}
+		})
+	}
+}
+
+// TestConnectClientValidation exercises connectClient's fast-fail validation
+// for proxy_url, none of which requires a live broker: every case here fails
+// validation and returns before ever dialing. The cases that pass
+// validation and fall through to a real (and unreachable) dial attempt are
+// covered by the tests below.
+func TestConnectClientValidation(t *testing.T) {
+	cases := []struct {
+		name           string
+		moduleConfig   moduleConfig
+		brokers        []string
+		wantErrContain string
+	}{
+		{
+			name:           "proxy_url rejected for plain tcp broker",
+			moduleConfig:   moduleConfig{ProxyURL: "http://proxy.invalid:3128"},
+			brokers:        []string{"tcp://broker.invalid:1883"},
+			wantErrContain: "only supported for ws",
+		},
+		{
+			name:           "proxy_url rejected for ssl broker",
+			moduleConfig:   moduleConfig{ProxyURL: "http://proxy.invalid:3128"},
+			brokers:        []string{"ssl://broker.invalid:8883"},
+			wantErrContain: "only supported for ws",
+		},
+		{
+			name:           "malformed proxy_url rejected",
+			moduleConfig:   moduleConfig{ProxyURL: "://not-a-url"},
+			brokers:        []string{"wss://broker.invalid:443"},
+			wantErrContain: "could not parse proxy_url",
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			_, _, err := connectClient(&tc.moduleConfig, tc.brokers, time.Second, nil, nil)
+			if err == nil {
+				t.Fatalf("expected an error, got none")
+			}
+			if !strings.Contains(err.Error(), tc.wantErrContain) {
+				t.Fatalf("expected error to contain %q, got %q", tc.wantErrContain, err.Error())
+			}
+		})
+	}
+}
+
+// TestConnectClientProxyURLAcceptedForWebsocket confirms that a wss:// broker
+// with proxy_url set passes connectClient's validation (unlike the tcp/ssl
+// cases above) and falls through to an actual dial attempt instead of being
+// rejected up front.
+func TestConnectClientProxyURLAcceptedForWebsocket(t *testing.T) {
+	moduleConfig := moduleConfig{ProxyURL: "http://proxy.invalid:3128"}
+	attempted := false
+	_, _, err := connectClient(&moduleConfig, []string{"wss://broker.invalid:443"}, 200*time.Millisecond, nil, func(string) {
+		attempted = true
+	})
+	if err == nil {
+		t.Fatalf("expected a dial error against an unreachable broker, got none")
+	}
+	if strings.Contains(err.Error(), "only supported for ws") {
+		t.Fatalf("proxy_url should be accepted for a wss:// broker, got validation error %q", err.Error())
+	}
+	if !attempted {
+		t.Fatalf("expected connectClient to attempt the dial instead of rejecting proxy_url up front")
+	}
+}
+
+// TestConnectClientHTTPHeadersDoesNotBlockConnect confirms http_headers
+// passes straight through to the websocket dialer (it's consulted by
+// paho.mqtt.golang itself, not validated here) and doesn't trip any
+// validation error before the dial attempt.
+func TestConnectClientHTTPHeadersDoesNotBlockConnect(t *testing.T) {
+	moduleConfig := moduleConfig{HTTPHeaders: map[string]string{"Authorization": "Bearer token"}}
+	attempted := false
+	_, _, err := connectClient(&moduleConfig, []string{"ws://broker.invalid:80"}, 200*time.Millisecond, nil, func(string) {
+		attempted = true
+	})
+	if err == nil {
+		t.Fatalf("expected a dial error against an unreachable broker, got none")
+	}
+	if !attempted {
+		t.Fatalf("expected connectClient to attempt the dial with http_headers set")
+	}
+}
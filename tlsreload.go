@@ -0,0 +1,193 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// certReloadInterval is the periodic fallback re-read, for editors/tools
+// that replace PKI files in ways fsnotify's watch on the files themselves
+// can miss (e.g. atomic-rename patterns, after which the watch no longer
+// follows the new file).
+const certReloadInterval = 5 * time.Minute
+
+// certReloader keeps an in-memory copy of a module's CA chain and client
+// keypair fresh, reloading from disk when the files change (via fsnotify) or
+// on a periodic timer as a fallback. It plugs into tls.Config through
+// GetClientCertificate and VerifyPeerCertificate so that certificate
+// rotation on disk takes effect on a probe's next MQTT connection attempt,
+// without requiring the exporter to restart.
+type certReloader struct {
+	caChainPath    string
+	clientCertPath string
+	clientKeyPath  string
+
+	mu         sync.RWMutex
+	caPool     *x509.CertPool
+	clientCert *tls.Certificate
+}
+
+// certReloaders caches one reloader per distinct (ca_chain, client_cert,
+// client_key) tuple, so that probes sharing a module also share a watcher
+// instead of re-reading and re-parsing PKI files on every run.
+var (
+	certReloadersMu sync.Mutex
+	certReloaders   = map[string]*certReloader{}
+)
+
+func getOrCreateCertReloader(moduleConfig *moduleConfig) (*certReloader, error) {
+	if moduleConfig.CAChain == "" && moduleConfig.ClientCert == "" && moduleConfig.ClientKey == "" {
+		return nil, nil
+	}
+
+	key := moduleConfig.CAChain + "|" + moduleConfig.ClientCert + "|" + moduleConfig.ClientKey
+
+	certReloadersMu.Lock()
+	defer certReloadersMu.Unlock()
+
+	if reloader, ok := certReloaders[key]; ok {
+		return reloader, nil
+	}
+
+	reloader := &certReloader{
+		caChainPath:    moduleConfig.CAChain,
+		clientCertPath: moduleConfig.ClientCert,
+		clientKeyPath:  moduleConfig.ClientKey,
+	}
+	if err := reloader.reload(); err != nil {
+		return nil, err
+	}
+	go reloader.watch()
+
+	certReloaders[key] = reloader
+	return reloader, nil
+}
+
+func (r *certReloader) reload() error {
+	var pool *x509.CertPool
+	if r.caChainPath != "" {
+		pemCerts, err := os.ReadFile(r.caChainPath)
+		if err != nil {
+			return err
+		}
+		pool = x509.NewCertPool()
+		pool.AppendCertsFromPEM(pemCerts)
+	}
+
+	var cert *tls.Certificate
+	if r.clientCertPath != "" && r.clientKeyPath != "" {
+		loaded, err := tls.LoadX509KeyPair(r.clientCertPath, r.clientKeyPath)
+		if err != nil {
+			return err
+		}
+		cert = &loaded
+	}
+
+	r.mu.Lock()
+	r.caPool = pool
+	r.clientCert = cert
+	r.mu.Unlock()
+	return nil
+}
+
+// watch reloads the PKI material whenever one of the watched files changes,
+// and additionally on a fixed interval as a fallback. It runs for the
+// lifetime of the process; reloaders are cached for their (ca/cert/key)
+// tuple and never torn down.
+func (r *certReloader) watch() {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		logger.Printf("TLS reload: could not start filesystem watcher for %s: %s", r.caChainPath, err.Error())
+	} else {
+		defer watcher.Close()
+		for _, path := range []string{r.caChainPath, r.clientCertPath, r.clientKeyPath} {
+			if path == "" {
+				continue
+			}
+			if err := watcher.Add(path); err != nil {
+				logger.Printf("TLS reload: could not watch %s: %s", path, err.Error())
+			}
+		}
+	}
+
+	ticker := time.NewTicker(certReloadInterval)
+	defer ticker.Stop()
+
+	var events <-chan fsnotify.Event
+	if watcher != nil {
+		events = watcher.Events
+	}
+
+	for {
+		select {
+		case event, ok := <-events:
+			if !ok {
+				events = nil
+				continue
+			}
+			if event.Op&(fsnotify.Write|fsnotify.Create|fsnotify.Rename) == 0 {
+				continue
+			}
+			if err := r.reload(); err != nil {
+				logger.Printf("TLS reload: failed to reload %s: %s", event.Name, err.Error())
+			}
+		case <-ticker.C:
+			if err := r.reload(); err != nil {
+				logger.Printf("TLS reload: periodic reload of %s failed: %s", r.caChainPath, err.Error())
+			}
+		}
+	}
+}
+
+// getClientCertificate implements tls.Config.GetClientCertificate, handing
+// out whatever keypair was most recently loaded from disk.
+func (r *certReloader) getClientCertificate(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if r.clientCert == nil {
+		return &tls.Certificate{}, nil
+	}
+	return r.clientCert, nil
+}
+
+// verifyPeerCertificate returns a tls.Config.VerifyPeerCertificate callback
+// that verifies the presented chain against whatever CA pool was most
+// recently loaded from disk, for serverName. The caller must set
+// InsecureSkipVerify so Go's built-in chain-building (against a fixed pool
+// captured at dial time) is bypassed in favor of this check - which means
+// Go's own hostname check is bypassed too, so this callback does it itself
+// via DNSName rather than just checking the chain.
+func (r *certReloader) verifyPeerCertificate(serverName string) func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+	return func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+		r.mu.RLock()
+		pool := r.caPool
+		r.mu.RUnlock()
+		// pool is nil when no custom CA chain was configured; VerifyOptions
+		// then falls back to the platform trust store, as Go's own
+		// verification would; a non-nil pool trusts only the loaded chain.
+
+		certs := make([]*x509.Certificate, 0, len(rawCerts))
+		for _, raw := range rawCerts {
+			cert, err := x509.ParseCertificate(raw)
+			if err != nil {
+				return err
+			}
+			certs = append(certs, cert)
+		}
+		if len(certs) == 0 {
+			return nil
+		}
+
+		opts := x509.VerifyOptions{Roots: pool, Intermediates: x509.NewCertPool(), DNSName: serverName}
+		for _, intermediate := range certs[1:] {
+			opts.Intermediates.AddCert(intermediate)
+		}
+		_, err := certs[0].Verify(opts)
+		return err
+	}
+}